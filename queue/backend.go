@@ -0,0 +1,64 @@
+//
+// backend.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+package queue
+
+import "github.com/yongman/tidis/store"
+
+// Backend wraps a store.Backend, routing Set/MSet/Delete/DeleteRange
+// through a Queue so many small concurrent writes coalesce into one
+// BatchInTxn per flush window. Every other method, including
+// DeleteRangeWithTxn, passes straight through to the wrapped backend
+// since those already run inside a caller-managed transaction.
+type Backend struct {
+	store.Backend
+	q Queue
+}
+
+var _ store.Backend = (*Backend)(nil)
+
+// NewBackend returns a store.Backend that queues its writes through q
+// before applying them to backend.
+func NewBackend(backend store.Backend, q Queue) *Backend {
+	return &Backend{Backend: backend, q: q}
+}
+
+func (b *Backend) Set(key []byte, value []byte) error {
+	res := b.q.Enqueue(&Op{Kind: OpSet, Key: key, Value: value})
+	return res.Err
+}
+
+func (b *Backend) MSet(kvm map[string][]byte) (int, error) {
+	res := b.q.Enqueue(&Op{Kind: OpMSet, KVs: kvm})
+	if res.Err != nil {
+		return 0, res.Err
+	}
+	return res.Value.(int), nil
+}
+
+func (b *Backend) Delete(keys [][]byte) (int, error) {
+	res := b.q.Enqueue(&Op{Kind: OpDelete, Keys: keys})
+	if res.Err != nil {
+		return 0, res.Err
+	}
+	return res.Value.(int), nil
+}
+
+func (b *Backend) DeleteRange(start []byte, end []byte, limit uint64) (uint64, error) {
+	res := b.q.Enqueue(&Op{Kind: OpDeleteRange, Start: start, End: end, Limit: limit})
+	if res.Err != nil {
+		return 0, res.Err
+	}
+	return res.Value.(uint64), nil
+}
+
+func (b *Backend) Close() error {
+	if err := b.q.Close(); err != nil {
+		return err
+	}
+	return b.Backend.Close()
+}
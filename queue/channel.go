@@ -0,0 +1,40 @@
+//
+// channel.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+package queue
+
+import (
+	"time"
+
+	"github.com/yongman/tidis/store"
+)
+
+// ChannelQueue is the in-memory Queue: fastest, since it never touches
+// disk, but any op still sitting in a flush window when the process
+// crashes is lost.
+type ChannelQueue struct {
+	c *coalescer
+}
+
+var _ Queue = (*ChannelQueue)(nil)
+
+func NewChannelQueue(backend store.Backend, maxBatch int, flushInterval time.Duration, maxInflightBytes int64) *ChannelQueue {
+	return &ChannelQueue{
+		c: newCoalescer(backend, maxBatch, flushInterval, maxInflightBytes, nil),
+	}
+}
+
+func (q *ChannelQueue) Enqueue(op *Op) Result {
+	op.Reply = make(chan Result, 1)
+	q.c.enqueue(op)
+	return <-op.Reply
+}
+
+func (q *ChannelQueue) Close() error {
+	q.c.close()
+	return nil
+}
@@ -0,0 +1,229 @@
+//
+// coalescer.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+package queue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yongman/tidis/store"
+)
+
+// coalescer is the flush loop shared by ChannelQueue and DiskQueue: it
+// drains pending ops off a channel and applies up to maxBatch of them
+// to backend inside a single BatchInTxn, either when the batch fills up
+// or every flushInterval, whichever comes first.
+type coalescer struct {
+	backend       store.Backend
+	maxBatch      int
+	flushInterval time.Duration
+
+	// afterFlush lets DiskQueue ack (delete) the persisted records for
+	// a batch once it has been applied; nil for ChannelQueue.
+	afterFlush func(ops []*Op)
+
+	pending chan *Op
+	closing chan struct{}
+	done    chan struct{}
+
+	// maxInflightBytes bounds the total size of ops queued but not yet
+	// flushed; 0 means unbounded. enqueue blocks until room frees up.
+	maxInflightBytes int64
+	mu               sync.Mutex
+	cond             *sync.Cond
+	inflightBytes    int64
+}
+
+func newCoalescer(backend store.Backend, maxBatch int, flushInterval time.Duration, maxInflightBytes int64, afterFlush func([]*Op)) *coalescer {
+	if maxBatch <= 0 {
+		maxBatch = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Millisecond
+	}
+
+	c := &coalescer{
+		backend:          backend,
+		maxBatch:         maxBatch,
+		flushInterval:    flushInterval,
+		afterFlush:       afterFlush,
+		pending:          make(chan *Op, maxBatch),
+		closing:          make(chan struct{}),
+		done:             make(chan struct{}),
+		maxInflightBytes: maxInflightBytes,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.run()
+	return c
+}
+
+// enqueue reserves op's share of the inflight byte budget (blocking if
+// it's exhausted) and hands op to the flush loop.
+func (c *coalescer) enqueue(op *Op) {
+	c.reserve(opSize(op))
+	c.pending <- op
+}
+
+func (c *coalescer) reserve(n int64) {
+	c.mu.Lock()
+	for c.maxInflightBytes > 0 && c.inflightBytes+n > c.maxInflightBytes {
+		c.cond.Wait()
+	}
+	c.inflightBytes += n
+	c.mu.Unlock()
+}
+
+func (c *coalescer) release(n int64) {
+	c.mu.Lock()
+	c.inflightBytes -= n
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *coalescer) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Op
+	var batchBytes int64
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		applyBatch(c.backend, batch)
+		if c.afterFlush != nil {
+			c.afterFlush(batch)
+		}
+		c.release(batchBytes)
+		batch = nil
+		batchBytes = 0
+	}
+
+	for {
+		select {
+		case op, ok := <-c.pending:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, op)
+			batchBytes += opSize(op)
+			if len(batch) >= c.maxBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-c.closing:
+			// Drain whatever is already buffered in pending before
+			// flushing: otherwise those ops' Reply never fires and
+			// their callers block on <-op.Reply forever (and for
+			// DiskQueue, their durable records sit unacked to replay
+			// on the next boot instead of completing now).
+		drain:
+			for {
+				select {
+				case op := <-c.pending:
+					batch = append(batch, op)
+					batchBytes += opSize(op)
+				default:
+					break drain
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
+
+func (c *coalescer) close() {
+	close(c.closing)
+	<-c.done
+}
+
+// applyBatch runs every op in batch inside a single BatchInTxn and
+// replies to each with the outcome, returning the same error. A failure
+// aborts the whole window, same as it would for any other BatchInTxn
+// caller: every op in the batch sees the same error. DiskQueue.replay
+// uses the returned error to decide whether it's safe to ack the
+// records it replayed.
+func applyBatch(backend store.Backend, batch []*Op) error {
+	_, err := backend.BatchInTxn(func(txn store.Txn) (interface{}, error) {
+		for _, op := range batch {
+			if opErr := applyOp(txn, op); opErr != nil {
+				return nil, opErr
+			}
+		}
+		return nil, nil
+	})
+
+	for _, op := range batch {
+		if err != nil {
+			op.Result.Err = err
+		}
+		if op.Reply != nil {
+			op.Reply <- op.Result
+		}
+	}
+	return err
+}
+
+// applyOp applies op through store.ApplyIndexedSet/ApplyIndexedDelete
+// rather than txn.Set/Delete directly, so a backend whose Txn maintains
+// side-band bookkeeping on every write (store/tikv's mvcc version-chain
+// index) sees that bookkeeping for queued writes too, not just ones
+// made directly through Backend.Set/MSet/Delete.
+func applyOp(txn store.Txn, op *Op) error {
+	switch op.Kind {
+	case OpSet:
+		return store.ApplyIndexedSet(txn, op.Key, op.Value)
+
+	case OpMSet:
+		for k, v := range op.KVs {
+			if err := store.ApplyIndexedSet(txn, []byte(k), v); err != nil {
+				return err
+			}
+		}
+		op.Result.Value = len(op.KVs)
+		return nil
+
+	case OpDelete:
+		ss := txn.GetSnapshot()
+		var deleted int
+		for _, k := range op.Keys {
+			v, _ := ss.Get(k)
+			if v != nil {
+				deleted++
+			}
+			if err := store.ApplyIndexedDelete(txn, k); err != nil {
+				return err
+			}
+		}
+		op.Result.Value = deleted
+		return nil
+
+	case OpDeleteRange:
+		n, err := store.DeleteRangeInTxn(txn, op.Start, op.End, op.Limit)
+		op.Result.Value = n
+		return err
+	}
+	return nil
+}
+
+func opSize(op *Op) int64 {
+	n := len(op.Key) + len(op.Value) + len(op.Start) + len(op.End)
+	for k, v := range op.KVs {
+		n += len(k) + len(v)
+	}
+	for _, k := range op.Keys {
+		n += len(k)
+	}
+	return int64(n)
+}
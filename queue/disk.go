@@ -0,0 +1,213 @@
+//
+// disk.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/yongman/tidis/config"
+	"github.com/yongman/tidis/store"
+)
+
+// syncWrite forces the record's Put to fsync before Enqueue returns,
+// so a crash right after can't lose an op the caller was told was
+// durable.
+var syncWrite = &opt.WriteOptions{Sync: true}
+
+// DiskQueue is the durable Queue: every op is fsynced to its own
+// goleveldb instance before being handed to the flush loop, and a
+// record is deleted once the batch containing it has been flushed,
+// whether that batch committed or failed (a failed op's caller has
+// already been handed the error). Pending records left behind by a crash are replayed into backend the
+// next time the queue is opened.
+type DiskQueue struct {
+	db  *leveldb.DB
+	c   *coalescer
+	seq uint64
+}
+
+var _ Queue = (*DiskQueue)(nil)
+
+// record is the durable, gob-encoded form of an Op: everything needed
+// to replay it, minus the Reply channel a restart can't restore.
+type record struct {
+	Kind  Kind
+	Key   []byte
+	Value []byte
+	KVs   map[string][]byte
+	Keys  [][]byte
+	Start []byte
+	End   []byte
+	Limit uint64
+}
+
+func OpenDiskQueue(conf *config.Config, backend store.Backend, flushInterval time.Duration) (*DiskQueue, error) {
+	db, err := leveldb.OpenFile(conf.Queue.DataDir, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	seq, err := lastSeq(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	q := &DiskQueue{db: db, seq: seq}
+	q.c = newCoalescer(backend, conf.Queue.MaxBatch, flushInterval, conf.Queue.MaxInflightBytes, q.ack)
+
+	if err := q.replay(backend); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *DiskQueue) Enqueue(op *Op) Result {
+	seq := atomic.AddUint64(&q.seq, 1)
+
+	data, err := encodeRecord(toRecord(op))
+	if err != nil {
+		return Result{Err: err}
+	}
+	if err := q.db.Put(seqKey(seq), data, syncWrite); err != nil {
+		return Result{Err: err}
+	}
+
+	op.seq = seq
+	op.Reply = make(chan Result, 1)
+	q.c.enqueue(op)
+	return <-op.Reply
+}
+
+func (q *DiskQueue) Close() error {
+	q.c.close()
+	return q.db.Close()
+}
+
+// ack deletes the durable records for a batch once it has been
+// flushed, committed or failed; it is the coalescer's afterFlush hook.
+func (q *DiskQueue) ack(batch []*Op) {
+	wb := new(leveldb.Batch)
+	for _, op := range batch {
+		wb.Delete(seqKey(op.seq))
+	}
+	// Best effort: the ops already got their replies, a leftover record
+	// here just means it gets replayed (and harmlessly re-applied) on
+	// the next boot.
+	q.db.Write(wb, nil)
+}
+
+// replay re-applies every record left over from a previous run (a
+// crash between Put and ack) before the queue starts accepting new ops.
+func (q *DiskQueue) replay(backend store.Backend) error {
+	iter := q.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	var pending []*Op
+	var seqs []uint64
+	for iter.Next() {
+		rec, err := decodeRecord(iter.Value())
+		if err != nil {
+			return err
+		}
+		pending = append(pending, fromRecord(rec))
+		seqs = append(seqs, decodeSeqKey(iter.Key()))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Only ack (delete) the replayed records once they have actually
+	// been applied: acking unconditionally would drop writes silently
+	// if this replay itself failed, instead of leaving them to retry on
+	// the next boot.
+	if err := applyBatch(backend, pending); err != nil {
+		return err
+	}
+
+	wb := new(leveldb.Batch)
+	for _, seq := range seqs {
+		wb.Delete(seqKey(seq))
+	}
+	return q.db.Write(wb, nil)
+}
+
+func lastSeq(db *leveldb.DB) (uint64, error) {
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	var last uint64
+	for iter.Next() {
+		if s := decodeSeqKey(iter.Key()); s > last {
+			last = s
+		}
+	}
+	return last, iter.Error()
+}
+
+func seqKey(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+func decodeSeqKey(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key)
+}
+
+func toRecord(op *Op) *record {
+	return &record{
+		Kind:  op.Kind,
+		Key:   op.Key,
+		Value: op.Value,
+		KVs:   op.KVs,
+		Keys:  op.Keys,
+		Start: op.Start,
+		End:   op.End,
+		Limit: op.Limit,
+	}
+}
+
+func fromRecord(rec *record) *Op {
+	return &Op{
+		Kind:  rec.Kind,
+		Key:   rec.Key,
+		Value: rec.Value,
+		KVs:   rec.KVs,
+		Keys:  rec.Keys,
+		Start: rec.Start,
+		End:   rec.End,
+		Limit: rec.Limit,
+	}
+}
+
+func encodeRecord(rec *record) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRecord(data []byte) (*record, error) {
+	var rec record
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
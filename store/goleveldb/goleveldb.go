@@ -0,0 +1,409 @@
+//
+// goleveldb.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Package goleveldb implements store.Backend on top of an embedded
+// goleveldb instance, so tidis can run for development, tests and
+// single-node deployments without a TiKV/PD cluster.
+package goleveldb
+
+import (
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/yongman/tidis/config"
+	"github.com/yongman/tidis/store"
+	"github.com/yongman/tidis/terror"
+)
+
+// Goleveldb is the store.Backend implementation backed by an embedded
+// goleveldb instance. Reads run off a point-in-time snapshot and writes
+// go through a WriteBatch so BatchInTxn gives the same all-or-nothing
+// semantics tidis command handlers get from the TiKV backend.
+type Goleveldb struct {
+	db       *leveldb.DB
+	txnRetry int
+
+	// goleveldb has no native multi-writer transactions, so BatchInTxn
+	// serializes writers the same way a single TiKV region would under
+	// contention.
+	mu sync.Mutex
+}
+
+var _ store.Backend = (*Goleveldb)(nil)
+
+func Open(conf *config.Config) (*Goleveldb, error) {
+	db, err := leveldb.OpenFile(conf.DataDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Goleveldb{db: db, txnRetry: conf.TxnRetry}, nil
+}
+
+func (ldb *Goleveldb) Close() error {
+	return ldb.db.Close()
+}
+
+func (ldb *Goleveldb) GetTxnRetry() int {
+	return ldb.txnRetry
+}
+
+func (ldb *Goleveldb) SetTxnRetry(count int) {
+	ldb.txnRetry = count
+}
+
+func (ldb *Goleveldb) Get(key []byte) ([]byte, error) {
+	v, err := ldb.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (ldb *Goleveldb) GetWithSnapshot(key []byte, ss store.Snapshot) ([]byte, error) {
+	return ss.Get(key)
+}
+
+// GetWithVersion ignores version: an embedded goleveldb instance keeps
+// only the latest value per key, it has no multi-version history.
+func (ldb *Goleveldb) GetWithVersion(key []byte, version uint64) ([]byte, error) {
+	return ldb.Get(key)
+}
+
+func (ldb *Goleveldb) GetNewestSnapshot() (store.Snapshot, error) {
+	snap, err := ldb.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &ldbSnapshot{snap: snap}, nil
+}
+
+func (ldb *Goleveldb) MGet(keys [][]byte) (map[string][]byte, error) {
+	kvm := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		v, err := ldb.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			kvm[string(k)] = v
+		}
+	}
+	return kvm, nil
+}
+
+// MGetWithVersion ignores version, see GetWithVersion.
+func (ldb *Goleveldb) MGetWithVersion(keys [][]byte, version uint64) (map[string][]byte, error) {
+	return ldb.MGet(keys)
+}
+
+func (ldb *Goleveldb) MGetWithSnapshot(keys [][]byte, ss store.Snapshot) (map[string][]byte, error) {
+	return ss.BatchGet(keys)
+}
+
+// set must be run in txn
+func (ldb *Goleveldb) Set(key []byte, value []byte) error {
+	f := func(txn store.Txn) (interface{}, error) {
+		return nil, txn.Set(key, value)
+	}
+
+	_, err := ldb.BatchInTxn(f)
+	return err
+}
+
+// map key cannot be []byte, use string
+func (ldb *Goleveldb) MSet(kvm map[string][]byte) (int, error) {
+	f := func(txn store.Txn) (interface{}, error) {
+		for k, v := range kvm {
+			if err := txn.Set([]byte(k), v); err != nil {
+				return 0, err
+			}
+		}
+		return len(kvm), nil
+	}
+
+	v, err := ldb.BatchInTxn(f)
+	return v.(int), err
+}
+
+func (ldb *Goleveldb) Delete(keys [][]byte) (int, error) {
+	f := func(txn store.Txn) (interface{}, error) {
+		ss := txn.GetSnapshot()
+
+		var deleted int = 0
+
+		for _, k := range keys {
+			v, _ := ss.Get(k)
+			if v != nil {
+				deleted++
+			}
+			if err := txn.Delete(k); err != nil {
+				return 0, err
+			}
+		}
+		return deleted, nil
+	}
+
+	v, err := ldb.BatchInTxn(f)
+	return v.(int), err
+}
+
+// ldbRange builds a goleveldb key range for [start, end) honouring
+// withend, since util.Range's Limit is always exclusive.
+func ldbRange(start []byte, end []byte, withend bool) *util.Range {
+	r := &util.Range{Start: start}
+	if end == nil {
+		return r
+	}
+	if withend {
+		r.Limit = append(append([]byte{}, end...), 0x00)
+	} else {
+		r.Limit = end
+	}
+	return r
+}
+
+func (ldb *Goleveldb) snapshotOrLatest(snapshot store.Snapshot) (*leveldb.Snapshot, func(), error) {
+	if snapshot == nil {
+		snap, err := ldb.db.GetSnapshot()
+		if err != nil {
+			return nil, nil, err
+		}
+		return snap, snap.Release, nil
+	}
+	ss, ok := snapshot.(*ldbSnapshot)
+	if !ok {
+		return nil, nil, terror.ErrBackendType
+	}
+	return ss.snap, func() {}, nil
+}
+
+func (ldb *Goleveldb) getRangeKeysWithFrontier(start []byte, withstart bool, end []byte, withend bool, offset, limit uint64, snapshot store.Snapshot, countOnly bool) ([][]byte, uint64, error) {
+	snap, release, err := ldb.snapshotOrLatest(snapshot)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	iter := newLdbIterator(snap.NewIterator(ldbRange(start, end, withend), nil), start, withstart)
+	defer iter.Close()
+
+	var keys [][]byte
+	var count uint64 = 0
+
+	for iter.Valid() && limit > 0 {
+		if offset > 0 {
+			offset--
+		} else {
+			if countOnly {
+				count++
+			} else {
+				keys = append(keys, iter.Key())
+			}
+			limit--
+		}
+		if err := iter.Next(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return keys, count, nil
+}
+
+func (ldb *Goleveldb) GetRangeKeysWithFrontier(start []byte, withstart bool, end []byte, withend bool, offset, limit uint64, snapshot store.Snapshot) ([][]byte, error) {
+	keys, _, err := ldb.getRangeKeysWithFrontier(start, withstart, end, withend, offset, limit, snapshot, false)
+	return keys, err
+}
+
+func (ldb *Goleveldb) GetRangeKeysCount(start []byte, withstart bool, end []byte, withend bool, limit uint64, snapshot store.Snapshot) (uint64, error) {
+	_, cnt, err := ldb.getRangeKeysWithFrontier(start, withstart, end, withend, 0, limit, snapshot, true)
+	return cnt, err
+}
+
+func (ldb *Goleveldb) GetRangeKeys(start []byte, end []byte, offset, limit uint64, snapshot store.Snapshot) ([][]byte, error) {
+	return ldb.GetRangeKeysWithFrontier(start, true, end, true, offset, limit, snapshot)
+}
+
+func (ldb *Goleveldb) GetRangeVals(start []byte, end []byte, limit uint64, snapshot store.Snapshot) ([][]byte, error) {
+	snap, release, err := ldb.snapshotOrLatest(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	iter := newLdbIterator(snap.NewIterator(ldbRange(start, end, true), nil), start, true)
+	defer iter.Close()
+
+	var vals [][]byte
+	for iter.Valid() && limit > 0 {
+		vals = append(vals, iter.Value())
+		limit--
+		if err := iter.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
+func (ldb *Goleveldb) GetRangeKeysVals(start []byte, end []byte, limit uint64, snapshot store.Snapshot) ([][]byte, error) {
+	snap, release, err := ldb.snapshotOrLatest(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	iter := newLdbIterator(snap.NewIterator(ldbRange(start, end, true), nil), start, true)
+	defer iter.Close()
+
+	var keyvals [][]byte
+	for iter.Valid() && limit > 0 {
+		keyvals = append(keyvals, iter.Key())
+		keyvals = append(keyvals, iter.Value())
+		limit--
+		if err := iter.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return keyvals, nil
+}
+
+func (ldb *Goleveldb) DeleteRange(start []byte, end []byte, limit uint64) (uint64, error) {
+	f := func(txn store.Txn) (interface{}, error) {
+		return store.DeleteRangeInTxn(txn, start, end, limit)
+	}
+
+	v, err := ldb.BatchInTxn(f)
+	if err != nil {
+		return 0, err
+	}
+	return v.(uint64), nil
+}
+
+func (ldb *Goleveldb) DeleteRangeWithTxn(start []byte, end []byte, limit uint64, txn store.Txn) (uint64, error) {
+	return store.DeleteRangeInTxn(txn, start, end, limit)
+}
+
+func (ldb *Goleveldb) BatchInTxn(f func(txn store.Txn) (interface{}, error)) (interface{}, error) {
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
+
+	snap, err := ldb.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	txn := &levelTxn{snap: snap, batch: new(leveldb.Batch)}
+
+	res, err := f(txn)
+	if err != nil {
+		return nil, err
+	}
+	if err := ldb.db.Write(txn.batch, nil); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ldbSnapshot adapts a *leveldb.Snapshot to store.Snapshot.
+type ldbSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+var _ store.Snapshot = (*ldbSnapshot)(nil)
+
+func (s *ldbSnapshot) Get(key []byte) ([]byte, error) {
+	v, err := s.snap.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (s *ldbSnapshot) BatchGet(keys [][]byte) (map[string][]byte, error) {
+	kvm := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		v, err := s.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			kvm[string(k)] = v
+		}
+	}
+	return kvm, nil
+}
+
+func (s *ldbSnapshot) Seek(start []byte) (store.Iterator, error) {
+	return newLdbIterator(s.snap.NewIterator(ldbRange(start, nil, true), nil), start, true), nil
+}
+
+func (s *ldbSnapshot) SeekRange(start []byte, end []byte) (store.Iterator, error) {
+	return newLdbIterator(s.snap.NewIterator(ldbRange(start, end, true), nil), start, true), nil
+}
+
+// ldbIterator adapts a goleveldb iterator.Iterator, positioned on its
+// first in-range key up front, to store.Iterator.
+type ldbIterator struct {
+	iter  iterator.Iterator
+	valid bool
+}
+
+var _ store.Iterator = (*ldbIterator)(nil)
+
+func newLdbIterator(it iterator.Iterator, start []byte, withstart bool) *ldbIterator {
+	i := &ldbIterator{iter: it, valid: it.First()}
+	if i.valid && !withstart && string(i.iter.Key()) == string(start) {
+		i.valid = i.iter.Next()
+	}
+	return i
+}
+
+func (i *ldbIterator) Valid() bool {
+	return i.valid
+}
+
+func (i *ldbIterator) Key() []byte {
+	return append([]byte{}, i.iter.Key()...)
+}
+
+func (i *ldbIterator) Value() []byte {
+	return append([]byte{}, i.iter.Value()...)
+}
+
+func (i *ldbIterator) Next() error {
+	i.valid = i.iter.Next()
+	return i.iter.Error()
+}
+
+func (i *ldbIterator) Close() {
+	i.iter.Release()
+}
+
+// levelTxn is the Txn handle BatchInTxn hands to its callback: reads go
+// against a point-in-time snapshot, writes accumulate in a batch that is
+// only applied once the callback returns successfully.
+type levelTxn struct {
+	snap  *leveldb.Snapshot
+	batch *leveldb.Batch
+}
+
+var _ store.Txn = (*levelTxn)(nil)
+
+func (txn *levelTxn) Set(key []byte, value []byte) error {
+	txn.batch.Put(key, value)
+	return nil
+}
+
+func (txn *levelTxn) Delete(key []byte) error {
+	txn.batch.Delete(key)
+	return nil
+}
+
+func (txn *levelTxn) GetSnapshot() store.Snapshot {
+	return &ldbSnapshot{snap: txn.snap}
+}
@@ -0,0 +1,152 @@
+//
+// goleveldb_test.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+package goleveldb
+
+import (
+	"testing"
+
+	"github.com/yongman/tidis/config"
+)
+
+func openTestDB(t *testing.T) *Goleveldb {
+	t.Helper()
+
+	ldb, err := Open(&config.Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { ldb.Close() })
+	return ldb
+}
+
+// TestSeekRangeInclusivity pins down that store.Snapshot.SeekRange
+// honours its documented [start, end] inclusive-inclusive contract:
+// a caller like store.DeleteRangeInTxn relies on end itself being
+// visited, not just keys strictly less than it.
+func TestSeekRangeInclusivity(t *testing.T) {
+	ldb := openTestDB(t)
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := ldb.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatalf("Set(%q): %v", k, err)
+		}
+	}
+
+	ss, err := ldb.GetNewestSnapshot()
+	if err != nil {
+		t.Fatalf("GetNewestSnapshot: %v", err)
+	}
+
+	iter, err := ss.SeekRange([]byte("b"), []byte("c"))
+	if err != nil {
+		t.Fatalf("SeekRange: %v", err)
+	}
+	defer iter.Close()
+
+	var got []string
+	for iter.Valid() {
+		got = append(got, string(iter.Key()))
+		if err := iter.Next(); err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+	}
+
+	want := []string{"b", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("SeekRange(b, c) = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("SeekRange(b, c) = %v, want %v", got, want)
+		}
+	}
+}
+
+// TestGetRangeKeysWithFrontierEdges covers the withstart (newLdbIterator)
+// and withend (ldbRange) handling through GetRangeKeysWithFrontier, since those flags
+// are what let a caller ask for a half-open range on either side of
+// Snapshot.SeekRange's always-inclusive contract.
+func TestGetRangeKeysWithFrontierEdges(t *testing.T) {
+	ldb := openTestDB(t)
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := ldb.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatalf("Set(%q): %v", k, err)
+		}
+	}
+
+	cases := []struct {
+		name      string
+		withstart bool
+		withend   bool
+		want      []string
+	}{
+		{"inclusive both ends", true, true, []string{"b", "c"}},
+		{"exclusive start", false, true, []string{"c"}},
+		{"exclusive end", true, false, []string{"b"}},
+		{"exclusive both ends", false, false, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := ldb.GetRangeKeysWithFrontier([]byte("b"), tc.withstart, []byte("c"), tc.withend, 0, 100, nil)
+			if err != nil {
+				t.Fatalf("GetRangeKeysWithFrontier: %v", err)
+			}
+
+			if len(keys) != len(tc.want) {
+				t.Fatalf("got %d keys %q, want %q", len(keys), keys, tc.want)
+			}
+			for i, w := range tc.want {
+				if string(keys[i]) != w {
+					t.Fatalf("got %q, want %q", keys, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// TestDeleteRangeInTxnInclusiveEnd guards against a regression back to
+// an exclusive upper bound: DeleteRangeInTxn (shared by every Backend's
+// DeleteRange) must remove end itself, not stop just short of it.
+func TestDeleteRangeInTxnInclusiveEnd(t *testing.T) {
+	ldb := openTestDB(t)
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := ldb.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatalf("Set(%q): %v", k, err)
+		}
+	}
+
+	n, err := ldb.DeleteRange([]byte("b"), []byte("c"), 0)
+	if err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("DeleteRange(b, c) deleted %d keys, want 2", n)
+	}
+
+	for _, k := range []string{"a", "d"} {
+		v, err := ldb.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("Get(%q): %v", k, err)
+		}
+		if v == nil {
+			t.Fatalf("Get(%q) = nil, want survivor untouched", k)
+		}
+	}
+	for _, k := range []string{"b", "c"} {
+		v, err := ldb.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("Get(%q): %v", k, err)
+		}
+		if v != nil {
+			t.Fatalf("Get(%q) = %q, want deleted", k, v)
+		}
+	}
+}
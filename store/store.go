@@ -0,0 +1,143 @@
+//
+// store.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Package store defines the storage-engine contract tidis command
+// handlers are written against, so a command handler never has to care
+// whether it is talking to a TiKV cluster or an embedded single-node
+// engine.
+package store
+
+import "math"
+
+// Iterator walks a key range in order. Implementations are already
+// positioned on the first matching key (if any) when returned by
+// Snapshot.Seek/SeekRange, mirroring tidb's kv.Iterator.
+type Iterator interface {
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Next() error
+	Close()
+}
+
+// Snapshot is a point-in-time read handle, returned by
+// Backend.GetNewestSnapshot and Txn.GetSnapshot.
+type Snapshot interface {
+	Get(key []byte) ([]byte, error)
+	BatchGet(keys [][]byte) (map[string][]byte, error)
+	Seek(start []byte) (Iterator, error)
+	// SeekRange opens an iterator over [start, end], inclusive at both
+	// ends.
+	SeekRange(start []byte, end []byte) (Iterator, error)
+}
+
+// Txn is the write handle Backend.BatchInTxn hands to its callback.
+type Txn interface {
+	Set(key []byte, value []byte) error
+	Delete(key []byte) error
+	GetSnapshot() Snapshot
+}
+
+// IndexedTxn is implemented by a Txn whose backend maintains side-band
+// bookkeeping alongside every write (store/tikv's MVCC version-chain
+// index, in particular). Anything that writes through a Txn outside of
+// Backend.Set/MSet/Delete itself — queue's write coalescer applying a
+// batched Op is the case that matters today — must call
+// ApplyIndexedSet/ApplyIndexedDelete instead of Txn.Set/Delete directly,
+// or that bookkeeping silently stops happening for queued writes.
+type IndexedTxn interface {
+	Txn
+	IndexedSet(key []byte, value []byte) error
+	IndexedDelete(key []byte) error
+}
+
+// ApplyIndexedSet writes key/value through txn, routing through
+// IndexedTxn's bookkeeping when txn supports it.
+func ApplyIndexedSet(txn Txn, key []byte, value []byte) error {
+	if it, ok := txn.(IndexedTxn); ok {
+		return it.IndexedSet(key, value)
+	}
+	return txn.Set(key, value)
+}
+
+// ApplyIndexedDelete deletes key through txn, routing through
+// IndexedTxn's bookkeeping when txn supports it.
+func ApplyIndexedDelete(txn Txn, key []byte) error {
+	if it, ok := txn.(IndexedTxn); ok {
+		return it.IndexedDelete(key)
+	}
+	return txn.Delete(key)
+}
+
+// Backend is the set of operations a tidis storage engine must provide.
+// store/tikv implements it against a TiKV cluster; store/goleveldb
+// implements it against an embedded goleveldb instance for development,
+// tests and single-node deployments that don't need a PD cluster.
+type Backend interface {
+	Close() error
+
+	GetTxnRetry() int
+	SetTxnRetry(count int)
+
+	Get(key []byte) ([]byte, error)
+	GetWithSnapshot(key []byte, ss Snapshot) ([]byte, error)
+	GetWithVersion(key []byte, version uint64) ([]byte, error)
+	GetNewestSnapshot() (Snapshot, error)
+
+	MGet(keys [][]byte) (map[string][]byte, error)
+	MGetWithVersion(keys [][]byte, version uint64) (map[string][]byte, error)
+	MGetWithSnapshot(keys [][]byte, ss Snapshot) (map[string][]byte, error)
+
+	Set(key []byte, value []byte) error
+	MSet(kvm map[string][]byte) (int, error)
+	Delete(keys [][]byte) (int, error)
+
+	GetRangeKeysWithFrontier(start []byte, withstart bool, end []byte, withend bool, offset, limit uint64, snapshot Snapshot) ([][]byte, error)
+	GetRangeKeysCount(start []byte, withstart bool, end []byte, withend bool, limit uint64, snapshot Snapshot) (uint64, error)
+	GetRangeKeys(start []byte, end []byte, offset, limit uint64, snapshot Snapshot) ([][]byte, error)
+	GetRangeVals(start []byte, end []byte, limit uint64, snapshot Snapshot) ([][]byte, error)
+	GetRangeKeysVals(start []byte, end []byte, limit uint64, snapshot Snapshot) ([][]byte, error)
+
+	DeleteRange(start []byte, end []byte, limit uint64) (uint64, error)
+	DeleteRangeWithTxn(start []byte, end []byte, limit uint64, txn Txn) (uint64, error)
+
+	// BatchInTxn runs f inside a single backend transaction, retrying on
+	// retryable conflicts, and commits once f returns successfully.
+	BatchInTxn(f func(txn Txn) (interface{}, error)) (interface{}, error)
+}
+
+// DeleteRangeInTxn removes up to limit keys in [start, end] by
+// enumerating them off txn's snapshot and deleting each through txn.
+// It is shared by every Backend implementation's DeleteRange and
+// DeleteRangeWithTxn, now that Snapshot/Txn are typed interfaces rather
+// than interface{}.
+func DeleteRangeInTxn(txn Txn, start []byte, end []byte, limit uint64) (uint64, error) {
+	// limit == 0 means no limited
+	if limit == 0 {
+		limit = math.MaxUint64
+	}
+
+	iter, err := txn.GetSnapshot().SeekRange(start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	var deleted uint64 = 0
+	for iter.Valid() && limit > 0 {
+		if err := txn.Delete(iter.Key()); err != nil {
+			return 0, err
+		}
+		deleted++
+		limit--
+
+		if err := iter.Next(); err != nil {
+			return 0, err
+		}
+	}
+	return deleted, nil
+}
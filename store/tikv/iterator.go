@@ -0,0 +1,126 @@
+//
+// iterator.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+package tikv
+
+import (
+	"github.com/pingcap/tidb/kv"
+)
+
+// boundedScanner is implemented by snapshots whose iterator can be
+// clipped to an end key natively. When available it lets a range scan
+// skip regions past the requested end instead of streaming every key
+// back to the client for Cmp-based filtering.
+type boundedScanner interface {
+	Iter(k kv.Key, upperBound kv.Key) (kv.Iterator, error)
+}
+
+// rangeIterator walks a [start, end] range, honouring withstart/withend
+// inclusivity, and prefers a backend's native end-key scanner over
+// seek-and-filter when one is available. Callers just loop on
+// Valid()/Next() without re-checking the end key themselves.
+type rangeIterator struct {
+	iter    kv.Iterator
+	end     []byte
+	withend bool
+}
+
+// SeekRange opens an iterator over [start, end], clipped server-side via
+// boundedScanner when the snapshot supports it, falling back to
+// ss.Seek(start) plus client-side Cmp(end) otherwise. A nil end means
+// unbounded. boundedScanner.Iter's upperBound is exclusive, so when end
+// is inclusive (withend) the scan is clipped to end's successor instead
+// of end itself, or the last key in range would never be seen.
+func SeekRange(ss kv.Snapshot, start []byte, withstart bool, end []byte, withend bool) (*rangeIterator, error) {
+	var (
+		iter kv.Iterator
+		err  error
+	)
+
+	if scanner, ok := ss.(boundedScanner); ok && end != nil {
+		upperBound := kv.Key(end)
+		if withend {
+			upperBound = upperBound.PrefixNext()
+		}
+		iter, err = scanner.Iter(start, upperBound)
+	} else {
+		iter, err = ss.Seek(start)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rangeIterator{iter: iter, end: end, withend: withend}
+
+	if iter.Valid() && !withstart && iter.Key().Cmp(start) == 0 {
+		if err := r.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Valid reports whether the iterator sits on a key within range. The
+// boundedScanner path above already clips to at most end (or its
+// successor), but this Cmp(end) check is still applied unconditionally
+// as a correctness backstop, not just an optimization for the unbounded
+// seek-and-filter path.
+func (r *rangeIterator) Valid() bool {
+	if !r.iter.Valid() {
+		return false
+	}
+	if r.end == nil {
+		return true
+	}
+	cmp := r.iter.Key().Cmp(r.end)
+	if cmp > 0 {
+		return false
+	}
+	return r.withend || cmp != 0
+}
+
+func (r *rangeIterator) Key() []byte {
+	return r.iter.Key()
+}
+
+func (r *rangeIterator) Value() []byte {
+	return r.iter.Value()
+}
+
+func (r *rangeIterator) Next() error {
+	return r.iter.Next()
+}
+
+func (r *rangeIterator) Close() {
+	r.iter.Close()
+}
+
+// kvIterator adapts a plain tidb kv.Iterator (unbounded, as returned by
+// kv.Snapshot.Seek) to store.Iterator.
+type kvIterator struct {
+	iter kv.Iterator
+}
+
+func (i *kvIterator) Valid() bool {
+	return i.iter.Valid()
+}
+
+func (i *kvIterator) Key() []byte {
+	return i.iter.Key()
+}
+
+func (i *kvIterator) Value() []byte {
+	return i.iter.Value()
+}
+
+func (i *kvIterator) Next() error {
+	return i.iter.Next()
+}
+
+func (i *kvIterator) Close() {
+	i.iter.Close()
+}
@@ -0,0 +1,401 @@
+//
+// mvcc.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+package tikv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/pingcap/tidb/kv"
+	"github.com/yongman/tidis/store"
+	"github.com/yongman/tidis/terror"
+)
+
+// errMvccIndexKey is returned when a stored mvcc index entry's physical
+// key doesn't decode to the (user key, revision) layout mvccEntryKey
+// writes.
+var errMvccIndexKey = errors.New("tikv: malformed mvcc index entry key")
+
+// errMvccKeyTooLarge is returned by indexPut/indexTombstone for a user
+// key too long for mvccEntryPrefix's 16-bit length field: indexing it
+// would silently collide with an unrelated key sharing the truncated
+// length and prefix bytes.
+var errMvccKeyTooLarge = errors.New("tikv: key too large to index")
+
+// maxIndexedKeyLen is the largest user key mvccEntryPrefix's length
+// field can represent.
+const maxIndexedKeyLen = 1<<16 - 1
+
+// mvccIndexPrefix namespaces the per-key version-chain index away from
+// user keyspace.
+var mvccIndexPrefix = []byte{0xff, 0xfe, 'm', 'v', 'c', 'c', ':'}
+
+// mvccSafePointKey holds the current GC safepoint, below which Compact
+// is free to drop superseded revisions.
+var mvccSafePointKey = []byte{0xff, 0xfe, 's', 'a', 'f', 'e', 'p', 'o', 'i', 'n', 't'}
+
+// mvccEntryPrefix is every physical key this user key's revisions are
+// stored under: mvccIndexPrefix, a 16-bit length so a later, longer user
+// key can never be mistaken for this one's continuation, then the key
+// itself. A revision's full physical key is this plus its own 8-byte
+// big-endian suffix (mvccEntryKey), so entries for one user key sort
+// contiguously and in revision order.
+func mvccEntryPrefix(key []byte) []byte {
+	buf := make([]byte, 0, len(mvccIndexPrefix)+2+len(key))
+	buf = append(buf, mvccIndexPrefix...)
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(key)))
+	buf = append(buf, lenBuf[:]...)
+	return append(buf, key...)
+}
+
+func mvccEntryKey(key []byte, revision uint64) []byte {
+	buf := mvccEntryPrefix(key)
+	var revBuf [8]byte
+	binary.BigEndian.PutUint64(revBuf[:], revision)
+	return append(buf, revBuf[:]...)
+}
+
+// parseMvccEntryKey splits a physical key built by mvccEntryKey back
+// into the user key and revision it encodes.
+func parseMvccEntryKey(physKey []byte) ([]byte, uint64, error) {
+	rest := physKey[len(mvccIndexPrefix):]
+	if len(rest) < 2 {
+		return nil, 0, errMvccIndexKey
+	}
+	klen := int(binary.BigEndian.Uint16(rest[:2]))
+	rest = rest[2:]
+	if len(rest) < klen+8 {
+		return nil, 0, errMvccIndexKey
+	}
+	return rest[:klen], binary.BigEndian.Uint64(rest[klen : klen+8]), nil
+}
+
+// prefixRangeEnd is the exclusive upper bound of the keyspace starting
+// with prefix: prefix with its last non-0xff byte incremented.
+func prefixRangeEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func mvccIndexRangeEnd() []byte {
+	return prefixRangeEnd(mvccIndexPrefix)
+}
+
+// generation is one unbroken run of revisions for a key, from its
+// creation (or re-creation after a delete) up to, and possibly
+// including, a tombstone. Mirrors etcd's key_index generation.
+type generation struct {
+	Revisions  []uint64
+	Tombstoned bool
+}
+
+// keyIndex is the in-memory reconstruction of a single user key's
+// version-chain, built from its revEntry rows (see entriesToGenerations)
+// purely to run compact's generation bookkeeping; nothing persists a
+// keyIndex as a whole (see revEntry's doc comment for why).
+type keyIndex struct {
+	Generations []generation
+}
+
+// revEntry is one physical mvcc index row: a key's single recorded
+// revision, live or tombstoned. Each revEntry is its own key
+// (mvccEntryKey), so recording one is a single Set with no read of the
+// key's prior history and no re-encoding of revisions already stored —
+// unlike an earlier version of this index, which kept one gob blob per
+// key and rewrote the whole thing on every write. Reconstructing
+// generations (entriesToGenerations) only happens for ListVersions/
+// Compact, off the hot write path.
+type revEntry struct {
+	Revision   uint64
+	Tombstoned bool
+}
+
+// entriesToGenerations regroups a revision-ascending entry list back
+// into generations: a tombstoned entry closes the current generation,
+// the next entry (if any) opens a new one.
+func entriesToGenerations(entries []revEntry) []generation {
+	var gens []generation
+	for _, e := range entries {
+		if n := len(gens); n == 0 || gens[n-1].Tombstoned {
+			gens = append(gens, generation{})
+		}
+		g := &gens[len(gens)-1]
+		g.Revisions = append(g.Revisions, e.Revision)
+		g.Tombstoned = e.Tombstoned
+	}
+	return gens
+}
+
+// loadRevisions returns every revEntry recorded for key, in increasing
+// revision order.
+func loadRevisions(ss store.Snapshot, key []byte) ([]revEntry, error) {
+	prefix := mvccEntryPrefix(key)
+	iter, err := ss.SeekRange(prefix, prefixRangeEnd(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var entries []revEntry
+	for iter.Valid() {
+		_, revision, err := parseMvccEntryKey(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, revEntry{Revision: revision, Tombstoned: iter.Value()[0] != 0})
+		if err := iter.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// versionsBetween returns every revision recorded for the key in
+// [fromTS, toTS], across all generations, in increasing order.
+func (idx *keyIndex) versionsBetween(fromTS, toTS uint64) []uint64 {
+	var out []uint64
+	for _, g := range idx.Generations {
+		for _, r := range g.Revisions {
+			if r >= fromTS && r <= toTS {
+				out = append(out, r)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// compact drops every revision <= safepoint except, per generation, the
+// largest one <= safepoint, so a read at any ts >= safepoint can still
+// resolve to the revision that was current at ts, and drops whole
+// generations once nothing live remains in them. It returns the dropped
+// revisions.
+func (idx *keyIndex) compact(safepoint uint64) []uint64 {
+	var pruned []uint64
+	var kept []generation
+
+	for _, g := range idx.Generations {
+		if len(g.Revisions) == 0 {
+			continue
+		}
+		newest := g.Revisions[len(g.Revisions)-1]
+
+		// floor is the largest revision <= safepoint: a read at any ts
+		// in [floor, the next kept revision) resolves to it, so it's
+		// the one revision at or below safepoint this generation needs
+		// to retain, not just the generation's overall newest.
+		var floor uint64
+		haveFloor := false
+		for _, r := range g.Revisions {
+			if r <= safepoint {
+				floor = r
+				haveFloor = true
+			}
+		}
+
+		var keptRevs []uint64
+		for _, r := range g.Revisions {
+			if r > safepoint || (haveFloor && r == floor) {
+				keptRevs = append(keptRevs, r)
+				continue
+			}
+			pruned = append(pruned, r)
+		}
+
+		// A tombstoned generation whose only survivor is its own
+		// tombstone, itself at or before safepoint, has nothing left
+		// any read could ever want: drop it entirely.
+		if g.Tombstoned && len(keptRevs) == 1 && keptRevs[0] == newest && newest <= safepoint {
+			pruned = append(pruned, newest)
+			continue
+		}
+		kept = append(kept, generation{Revisions: keptRevs, Tombstoned: g.Tombstoned})
+	}
+
+	idx.Generations = kept
+	return pruned
+}
+
+// indexPut records revision as a new, live version of key: one Set, no
+// read of key's prior revisions. Called from inside the same BatchInTxn
+// as the write it documents, so the index update commits atomically
+// with the data it describes. Shared by *Txn.IndexedSet, which is how
+// every indexed write reaches it whether it came from Tikv.Set/MSet or
+// from queue's write coalescer.
+func indexPut(txn store.Txn, key []byte, revision uint64) error {
+	if len(key) > maxIndexedKeyLen {
+		return errMvccKeyTooLarge
+	}
+	return txn.Set(mvccEntryKey(key, revision), []byte{0})
+}
+
+// indexTombstone records revision as the delete of key. It does not
+// check whether key has any prior recorded revision: doing so would
+// need a read before every delete, defeating indexPut's whole point.
+// Tombstoning a key with no live generation (never Set, or already
+// deleted) just adds a phantom generation that ListVersions reports
+// and Compact prunes like any other once it falls behind the
+// safepoint — harmless bookkeeping noise, not a correctness issue for
+// keys that were actually written.
+func indexTombstone(txn store.Txn, key []byte, revision uint64) error {
+	if len(key) > maxIndexedKeyLen {
+		return errMvccKeyTooLarge
+	}
+	return txn.Set(mvccEntryKey(key, revision), []byte{1})
+}
+
+// txnRevision is the revision a write inside txn should record: the
+// transaction's start timestamp. TiKV assigns commit timestamps at
+// commit time, after f has already run, so start timestamp is the only
+// per-transaction number available to stamp the index with; since
+// start timestamps are handed out by PD in issue order this is
+// monotonically increasing in practice, which is what ListVersions'
+// ordering relies on.
+//
+// Because of this, the index only ever promises an ordered revision
+// history (ListVersions) — it deliberately has no GetAtVersion/
+// GetRangeAtVersion read path: GetWithVersion/GetRangeKeysVals read a
+// tidb snapshot by commitTS (kv.Version{Ver: version}), not by StartTS,
+// and commitTS > StartTS with no fixed bound between them, so a read at
+// version == a revision ListVersions just returned would not be
+// guaranteed to see that revision's own write. Shipping that read path
+// needs revisions stamped with commitTS instead, which isn't available
+// until after BatchInTxn's Commit call returns — by which point the
+// index entry describing it would already need to be written, in the
+// same transaction, to stay atomic with the data.
+func txnRevision(txn store.Txn) (uint64, error) {
+	t, ok := txn.(*Txn)
+	if !ok {
+		return 0, terror.ErrBackendType
+	}
+	return t.txn.StartTS(), nil
+}
+
+// ListVersions returns every revision recorded for key in [fromTS, toTS].
+func (tikv *Tikv) ListVersions(key []byte, fromTS, toTS uint64) ([]uint64, error) {
+	ss, err := tikv.store.GetSnapshot(kv.MaxVersion)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := loadRevisions(&Snapshot{ss: ss}, key)
+	if err != nil {
+		return nil, err
+	}
+	idx := &keyIndex{Generations: entriesToGenerations(entries)}
+	return idx.versionsBetween(fromTS, toTS), nil
+}
+
+// SetSafePoint advances the GC safepoint: Compact is free to drop any
+// revision at or below ts once called. Written through a raw,
+// un-indexed txn.Set rather than Tikv.Set: indexing this key would
+// create an mvcc index entry for mvccSafePointKey itself, which
+// Compact's scan over the index keyspace would then walk and prune as
+// if it were ordinary user data.
+func (tikv *Tikv) SetSafePoint(ts uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, ts)
+
+	f := func(txn store.Txn) (interface{}, error) {
+		return nil, txn.Set(mvccSafePointKey, buf)
+	}
+	_, err := tikv.BatchInTxn(f)
+	return err
+}
+
+// GetSafePoint returns the current GC safepoint, or 0 if none has been
+// set yet.
+func (tikv *Tikv) GetSafePoint() (uint64, error) {
+	v, err := tikv.Get(mvccSafePointKey)
+	if err != nil || v == nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+// PrunedVersion identifies one version-chain entry Compact dropped, so
+// a caller can also remove the data row it pointed at.
+type PrunedVersion struct {
+	Key      []byte
+	Revision uint64
+}
+
+// Compact scans the whole mvcc index keyspace in physical key order —
+// which, thanks to mvccEntryPrefix's length-prefixed encoding, groups
+// contiguously by user key — and for each key's run of revEntry rows,
+// drops whatever keyIndex.compact says is safe to drop at or below
+// safepoint by deleting just those rows; kept revisions are never
+// rewritten, since each already lives at its own physical key. It
+// returns every pruned (key, revision) pair.
+//
+// Compact does not itself delete versioned data rows: TiKV's own
+// snapshot GC already reclaims superseded MVCC values below its GC
+// safepoint, so this only needs to keep tidis's own version-chain index
+// from growing without bound.
+func (tikv *Tikv) Compact(safepoint uint64) ([]PrunedVersion, error) {
+	var pruned []PrunedVersion
+
+	f := func(txn store.Txn) (interface{}, error) {
+		iter, err := txn.GetSnapshot().SeekRange(mvccIndexPrefix, mvccIndexRangeEnd())
+		if err != nil {
+			return nil, err
+		}
+		defer iter.Close()
+
+		var curKey []byte
+		var curEntries []revEntry
+
+		flush := func() error {
+			if curKey == nil {
+				return nil
+			}
+			idx := &keyIndex{Generations: entriesToGenerations(curEntries)}
+			for _, r := range idx.compact(safepoint) {
+				pruned = append(pruned, PrunedVersion{Key: append([]byte{}, curKey...), Revision: r})
+				if err := txn.Delete(mvccEntryKey(curKey, r)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		for iter.Valid() {
+			userKey, revision, err := parseMvccEntryKey(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+
+			if curKey == nil || !bytes.Equal(userKey, curKey) {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				// iter.Key()'s backing array isn't guaranteed to
+				// survive iter.Next(), so copy userKey before holding
+				// onto it across iterations.
+				curKey, curEntries = append([]byte{}, userKey...), nil
+			}
+			curEntries = append(curEntries, revEntry{Revision: revision, Tombstoned: iter.Value()[0] != 0})
+
+			if err := iter.Next(); err != nil {
+				return nil, err
+			}
+		}
+		return nil, flush()
+	}
+
+	_, err := tikv.BatchInTxn(f)
+	return pruned, err
+}
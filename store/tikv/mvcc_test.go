@@ -0,0 +1,130 @@
+//
+// mvcc_test.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+package tikv
+
+import "testing"
+
+// TestKeyIndexCompact covers compact's per-generation floor retention
+// and whole-generation tombstone drop, the two boundaries a bug here
+// would silently lose live data across: compacting too aggressively
+// loses a revision a read at some ts >= safepoint still needs, and
+// compacting too conservatively leaks tombstoned generations forever.
+func TestKeyIndexCompact(t *testing.T) {
+	cases := []struct {
+		name       string
+		gens       []generation
+		safepoint  uint64
+		wantPruned []uint64
+		wantKept   []generation
+	}{
+		{
+			name:       "keeps floor revision, drops everything below it",
+			gens:       []generation{{Revisions: []uint64{10, 20, 30}}},
+			safepoint:  25,
+			wantPruned: []uint64{10},
+			wantKept:   []generation{{Revisions: []uint64{20, 30}}},
+		},
+		{
+			name:       "safepoint exactly on a revision keeps that one as the floor",
+			gens:       []generation{{Revisions: []uint64{10, 20, 30}}},
+			safepoint:  20,
+			wantPruned: []uint64{10},
+			wantKept:   []generation{{Revisions: []uint64{20, 30}}},
+		},
+		{
+			name:       "safepoint below every revision prunes nothing",
+			gens:       []generation{{Revisions: []uint64{10, 20, 30}}},
+			safepoint:  5,
+			wantPruned: nil,
+			wantKept:   []generation{{Revisions: []uint64{10, 20, 30}}},
+		},
+		{
+			name:       "tombstoned generation fully below safepoint is dropped entirely",
+			gens:       []generation{{Revisions: []uint64{10, 20}, Tombstoned: true}},
+			safepoint:  25,
+			wantPruned: []uint64{10, 20},
+			wantKept:   nil,
+		},
+		{
+			name:       "tombstoned generation whose floor isn't its newest revision survives whole",
+			gens:       []generation{{Revisions: []uint64{10, 20}, Tombstoned: true}},
+			safepoint:  15,
+			wantPruned: nil,
+			wantKept:   []generation{{Revisions: []uint64{10, 20}, Tombstoned: true}},
+		},
+		{
+			name: "older generation drops, newer live generation untouched",
+			gens: []generation{
+				{Revisions: []uint64{10, 20}, Tombstoned: true},
+				{Revisions: []uint64{30}},
+			},
+			safepoint:  20,
+			wantPruned: []uint64{10, 20},
+			wantKept:   []generation{{Revisions: []uint64{30}}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			idx := &keyIndex{Generations: append([]generation{}, tc.gens...)}
+			pruned := idx.compact(tc.safepoint)
+
+			if !equalUint64s(pruned, tc.wantPruned) {
+				t.Fatalf("compact(%d) pruned = %v, want %v", tc.safepoint, pruned, tc.wantPruned)
+			}
+			if !equalGenerations(idx.Generations, tc.wantKept) {
+				t.Fatalf("compact(%d) kept = %v, want %v", tc.safepoint, idx.Generations, tc.wantKept)
+			}
+		})
+	}
+}
+
+// TestEntriesToGenerations covers the revEntry -> generation regrouping
+// Compact and ListVersions both build on: a tombstone closes the
+// current generation and the next live entry (if any) opens a new one.
+func TestEntriesToGenerations(t *testing.T) {
+	entries := []revEntry{
+		{Revision: 10},
+		{Revision: 20, Tombstoned: true},
+		{Revision: 30},
+		{Revision: 40},
+	}
+
+	got := entriesToGenerations(entries)
+	want := []generation{
+		{Revisions: []uint64{10, 20}, Tombstoned: true},
+		{Revisions: []uint64{30, 40}},
+	}
+	if !equalGenerations(got, want) {
+		t.Fatalf("entriesToGenerations = %v, want %v", got, want)
+	}
+}
+
+func equalUint64s(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalGenerations(a, b []generation) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Tombstoned != b[i].Tombstoned || !equalUint64s(a[i].Revisions, b[i].Revisions) {
+			return false
+		}
+	}
+	return true
+}
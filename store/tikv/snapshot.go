@@ -0,0 +1,112 @@
+//
+// snapshot.go
+// Copyright (C) 2018 YanMing <yming0221@gmail.com>
+//
+// Distributed under terms of the MIT license.
+//
+
+package tikv
+
+import (
+	"github.com/pingcap/tidb/kv"
+	"github.com/yongman/tidis/store"
+)
+
+// Snapshot adapts a tidb kv.Snapshot to store.Snapshot.
+type Snapshot struct {
+	ss kv.Snapshot
+}
+
+var _ store.Snapshot = (*Snapshot)(nil)
+
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	v, err := s.ss.Get(key)
+	if err != nil {
+		if kv.IsErrNotFound(err) {
+			return nil, nil
+		}
+	}
+	return v, err
+}
+
+func (s *Snapshot) BatchGet(keys [][]byte) (map[string][]byte, error) {
+	nkeys := make([]kv.Key, len(keys))
+	for i := 0; i < len(keys); i++ {
+		nkeys[i] = keys[i]
+	}
+	return s.ss.BatchGet(nkeys)
+}
+
+func (s *Snapshot) Seek(start []byte) (store.Iterator, error) {
+	iter, err := s.ss.Seek(start)
+	if err != nil {
+		return nil, err
+	}
+	return &kvIterator{iter: iter}, nil
+}
+
+func (s *Snapshot) SeekRange(start []byte, end []byte) (store.Iterator, error) {
+	return SeekRange(s.ss, start, true, end, true)
+}
+
+// Txn adapts a tidb kv.Transaction to store.Txn.
+type Txn struct {
+	txn kv.Transaction
+
+	// indexEnabled mirrors the owning Tikv's mvccEnabled at the time
+	// this Txn was opened: IndexedSet/IndexedDelete skip the mvcc index
+	// entirely when it's false, so indexing stays opt-in per config
+	// rather than an unconditional tax on every write.
+	indexEnabled bool
+}
+
+var _ store.Txn = (*Txn)(nil)
+
+func (t *Txn) Set(key []byte, value []byte) error {
+	return t.txn.Set(key, value)
+}
+
+func (t *Txn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+func (t *Txn) GetSnapshot() store.Snapshot {
+	return &Snapshot{ss: t.txn.GetSnapshot()}
+}
+
+var _ store.IndexedTxn = (*Txn)(nil)
+
+// IndexedSet sets key/value and records the write in the mvcc
+// version-chain index (see mvcc.go), atomically with t's other writes.
+// This is what store.ApplyIndexedSet routes to for a *Txn, so a write
+// applied through here looks the same to the index whether it came from
+// Tikv.Set/MSet or from queue's write coalescer.
+func (t *Txn) IndexedSet(key []byte, value []byte) error {
+	if err := t.txn.Set(key, value); err != nil {
+		return err
+	}
+	if !t.indexEnabled {
+		return nil
+	}
+	rev, err := txnRevision(t)
+	if err != nil {
+		return err
+	}
+	return indexPut(t, key, rev)
+}
+
+// IndexedDelete deletes key and records the delete in the mvcc
+// version-chain index, atomically with t's other writes.
+func (t *Txn) IndexedDelete(key []byte) error {
+	if err := t.txn.Delete(key); err != nil {
+		return err
+	}
+	if !t.indexEnabled {
+		return nil
+	}
+	rev, err := txnRevision(t)
+	if err != nil {
+		return err
+	}
+	return indexTombstone(t, key, rev)
+}
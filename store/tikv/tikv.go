@@ -17,22 +17,31 @@ import (
 	ti "github.com/pingcap/tidb/store/tikv"
 	"github.com/yongman/go/log"
 	"github.com/yongman/tidis/config"
+	"github.com/yongman/tidis/store"
 	"github.com/yongman/tidis/terror"
 	"golang.org/x/net/context"
 )
 
+// Tikv is the store.Backend implementation backed by a TiKV cluster.
 type Tikv struct {
 	store    kv.Storage
 	txnRetry int
+
+	// mvccEnabled gates the version-chain index (mvcc.go): every
+	// indexed write costs one extra TiKV RPC, so it defaults to off and
+	// is only paid for when conf.Mvcc.Enabled opts in.
+	mvccEnabled bool
 }
 
+var _ store.Backend = (*Tikv)(nil)
+
 func Open(conf *config.Config) (*Tikv, error) {
 	d := ti.Driver{}
 	store, err := d.Open(fmt.Sprintf("tikv://%s/pd?cluster=1", conf.PdAddr))
 	if err != nil {
 		return nil, err
 	}
-	return &Tikv{store: store, txnRetry: conf.TxnRetry}, nil
+	return &Tikv{store: store, txnRetry: conf.TxnRetry, mvccEnabled: conf.Mvcc.Enabled}, nil
 }
 
 var (
@@ -75,22 +84,16 @@ func (tikv *Tikv) Get(key []byte) ([]byte, error) {
 	return v, err
 }
 
-func (tikv *Tikv) GetWithSnapshot(key []byte, ss interface{}) ([]byte, error) {
-	snapshot, ok := ss.(kv.Snapshot)
-	if !ok {
-		return nil, terror.ErrBackendType
-	}
-	v, err := snapshot.Get(key)
-	if err != nil {
-		if kv.IsErrNotFound(err) {
-			return nil, nil
-		}
-	}
-	return v, err
+func (tikv *Tikv) GetWithSnapshot(key []byte, ss store.Snapshot) ([]byte, error) {
+	return ss.Get(key)
 }
 
-func (tikv *Tikv) GetNewestSnapshot() (interface{}, error) {
-	return tikv.store.GetSnapshot(kv.MaxVersion)
+func (tikv *Tikv) GetNewestSnapshot() (store.Snapshot, error) {
+	ss, err := tikv.store.GetSnapshot(kv.MaxVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{ss: ss}, nil
 }
 
 func (tikv *Tikv) GetWithVersion(key []byte, version uint64) ([]byte, error) {
@@ -133,25 +136,14 @@ func (tikv *Tikv) MGetWithVersion(keys [][]byte, version uint64) (map[string][]b
 	return ss.BatchGet(nkeys)
 }
 
-func (tikv *Tikv) MGetWithSnapshot(keys [][]byte, ss interface{}) (map[string][]byte, error) {
-	snapshot, ok := ss.(kv.Snapshot)
-	if !ok {
-		return nil, terror.ErrBackendType
-	}
-	// TODO
-	nkeys := make([]kv.Key, len(keys))
-	for i := 0; i < len(keys); i++ {
-		nkeys[i] = keys[i]
-	}
-	return snapshot.BatchGet(nkeys)
+func (tikv *Tikv) MGetWithSnapshot(keys [][]byte, ss store.Snapshot) (map[string][]byte, error) {
+	return ss.BatchGet(keys)
 }
 
 // set must be run in txn
 func (tikv *Tikv) Set(key []byte, value []byte) error {
-	f := func(txn1 interface{}) (interface{}, error) {
-		txn, _ := txn1.(kv.Transaction)
-		err := txn.Set(key, value)
-		return nil, err
+	f := func(txn store.Txn) (interface{}, error) {
+		return nil, store.ApplyIndexedSet(txn, key, value)
 	}
 
 	_, err := tikv.BatchInTxn(f)
@@ -160,12 +152,9 @@ func (tikv *Tikv) Set(key []byte, value []byte) error {
 
 // map key cannot be []byte, use string
 func (tikv *Tikv) MSet(kvm map[string][]byte) (int, error) {
-	f := func(txn1 interface{}) (interface{}, error) {
-		txn, _ := txn1.(kv.Transaction)
-
+	f := func(txn store.Txn) (interface{}, error) {
 		for k, v := range kvm {
-			err := txn.Set([]byte(k), v)
-			if err != nil {
+			if err := store.ApplyIndexedSet(txn, []byte(k), v); err != nil {
 				return 0, err
 			}
 		}
@@ -177,19 +166,17 @@ func (tikv *Tikv) MSet(kvm map[string][]byte) (int, error) {
 }
 
 func (tikv *Tikv) Delete(keys [][]byte) (int, error) {
-	f := func(txn1 interface{}) (interface{}, error) {
-		txn, _ := txn1.(kv.Transaction)
+	f := func(txn store.Txn) (interface{}, error) {
 		ss := txn.GetSnapshot()
 
 		var deleted int = 0
 
 		for _, k := range keys {
-			v, _ := tikv.GetWithSnapshot(k, ss)
+			v, _ := ss.Get(k)
 			if v != nil {
 				deleted++
 			}
-			err := txn.Delete(k)
-			if err != nil {
+			if err := store.ApplyIndexedDelete(txn, k); err != nil {
 				return 0, err
 			}
 		}
@@ -201,101 +188,77 @@ func (tikv *Tikv) Delete(keys [][]byte) (int, error) {
 	return v.(int), err
 }
 
-func (tikv *Tikv) getRangeKeysWithFrontier(start []byte, withstart bool, end []byte, withend bool, offset, limit uint64, snapshot interface{}, countOnly bool) ([][]byte, uint64, error) {
-	// get latest ss
-	var ss kv.Snapshot
-	var err error
-	var ok bool
-	var count uint64 = 0
+// snapshotOrLatest resolves snapshot to the underlying kv.Snapshot it
+// wraps, taking a fresh one at the latest version when snapshot is nil.
+func (tikv *Tikv) snapshotOrLatest(snapshot store.Snapshot) (kv.Snapshot, error) {
 	if snapshot == nil {
-		ss, err = tikv.store.GetSnapshot(kv.MaxVersion)
-		if err != nil {
-			return nil, 0, err
-		}
-	} else {
-		ss, ok = snapshot.(kv.Snapshot)
-		if !ok {
-			return nil, 0, terror.ErrBackendType
-		}
+		return tikv.store.GetSnapshot(kv.MaxVersion)
+	}
+	ss, ok := snapshot.(*Snapshot)
+	if !ok {
+		return nil, terror.ErrBackendType
+	}
+	return ss.ss, nil
+}
+
+func (tikv *Tikv) getRangeKeysWithFrontier(start []byte, withstart bool, end []byte, withend bool, offset, limit uint64, snapshot store.Snapshot, countOnly bool) ([][]byte, uint64, error) {
+	ss, err := tikv.snapshotOrLatest(snapshot)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	iter, err := ss.Seek(start)
+	iter, err := SeekRange(ss, start, withstart, end, withend)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer iter.Close()
 
 	var keys [][]byte
+	var count uint64 = 0
 
-	for limit > 0 {
-		if !iter.Valid() {
-			break
-		}
-
+	for iter.Valid() && limit > 0 {
 		key := iter.Key()
 
-		err = iter.Next()
-		if err != nil {
-			return nil, 0, err
-		}
-
-		if !withstart && key.Cmp(start) == 0 {
-			continue
-		}
-		if !withend && key.Cmp(end) == 0 {
-			break
-		}
-
-		if end != nil && key.Cmp(end) > 0 {
-			break
-		}
-
 		if offset > 0 {
 			offset--
-			continue
-		}
-		if countOnly {
-			count++
 		} else {
-			keys = append(keys, key)
+			if countOnly {
+				count++
+			} else {
+				keys = append(keys, key)
+			}
+			limit--
+		}
+
+		err = iter.Next()
+		if err != nil {
+			return nil, 0, err
 		}
-		limit--
 	}
 	return keys, count, nil
 }
 
-func (tikv *Tikv) GetRangeKeysWithFrontier(start []byte, withstart bool, end []byte, withend bool, offset, limit uint64, snapshot interface{}) ([][]byte, error) {
+func (tikv *Tikv) GetRangeKeysWithFrontier(start []byte, withstart bool, end []byte, withend bool, offset, limit uint64, snapshot store.Snapshot) ([][]byte, error) {
 	keys, _, err := tikv.getRangeKeysWithFrontier(start, withstart, end, withend, offset, limit, snapshot, false)
 	return keys, err
 }
 
-func (tikv *Tikv) GetRangeKeysCount(start []byte, withstart bool, end []byte, withend bool, limit uint64, snapshot interface{}) (uint64, error) {
+func (tikv *Tikv) GetRangeKeysCount(start []byte, withstart bool, end []byte, withend bool, limit uint64, snapshot store.Snapshot) (uint64, error) {
 	_, cnt, err := tikv.getRangeKeysWithFrontier(start, withstart, end, withend, 0, limit, snapshot, true)
 	return cnt, err
 }
 
-func (tikv *Tikv) GetRangeKeys(start []byte, end []byte, offset, limit uint64, snapshot interface{}) ([][]byte, error) {
+func (tikv *Tikv) GetRangeKeys(start []byte, end []byte, offset, limit uint64, snapshot store.Snapshot) ([][]byte, error) {
 	return tikv.GetRangeKeysWithFrontier(start, true, end, true, offset, limit, snapshot)
 }
 
-func (tikv *Tikv) GetRangeVals(start []byte, end []byte, limit uint64, snapshot interface{}) ([][]byte, error) {
-	// get latest ss
-	var ss kv.Snapshot
-	var err error
-	var ok bool
-	if snapshot == nil {
-		ss, err = tikv.store.GetSnapshot(kv.MaxVersion)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		ss, ok = snapshot.(kv.Snapshot)
-		if !ok {
-			return nil, terror.ErrBackendType
-		}
+func (tikv *Tikv) GetRangeVals(start []byte, end []byte, limit uint64, snapshot store.Snapshot) ([][]byte, error) {
+	ss, err := tikv.snapshotOrLatest(snapshot)
+	if err != nil {
+		return nil, err
 	}
 
-	iter, err := ss.Seek(start)
+	iter, err := SeekRange(ss, start, true, end, true)
 	if err != nil {
 		return nil, err
 	}
@@ -303,18 +266,8 @@ func (tikv *Tikv) GetRangeVals(start []byte, end []byte, limit uint64, snapshot
 
 	var vals [][]byte
 
-	for limit > 0 {
-		if !iter.Valid() {
-			break
-		}
-
-		key := iter.Key()
-		val := iter.Value()
-
-		if end != nil && key.Cmp(end) > 0 {
-			break
-		}
-		vals = append(vals, val)
+	for iter.Valid() && limit > 0 {
+		vals = append(vals, iter.Value())
 		limit--
 		err = iter.Next()
 		if err != nil {
@@ -324,24 +277,13 @@ func (tikv *Tikv) GetRangeVals(start []byte, end []byte, limit uint64, snapshot
 	return vals, nil
 }
 
-func (tikv *Tikv) GetRangeKeysVals(start []byte, end []byte, limit uint64, snapshot interface{}) ([][]byte, error) {
-	// get latest ss
-	var ss kv.Snapshot
-	var err error
-	var ok bool
-	if snapshot == nil {
-		ss, err = tikv.store.GetSnapshot(kv.MaxVersion)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		ss, ok = snapshot.(kv.Snapshot)
-		if !ok {
-			return nil, terror.ErrBackendType
-		}
+func (tikv *Tikv) GetRangeKeysVals(start []byte, end []byte, limit uint64, snapshot store.Snapshot) ([][]byte, error) {
+	ss, err := tikv.snapshotOrLatest(snapshot)
+	if err != nil {
+		return nil, err
 	}
 
-	iter, err := ss.Seek(start)
+	iter, err := SeekRange(ss, start, true, end, true)
 	if err != nil {
 		return nil, err
 	}
@@ -349,20 +291,9 @@ func (tikv *Tikv) GetRangeKeysVals(start []byte, end []byte, limit uint64, snaps
 
 	var keyvals [][]byte
 
-	for limit > 0 {
-		if !iter.Valid() {
-			break
-		}
-
-		key := iter.Key()
-		value := iter.Value()
-
-		if end != nil && key.Cmp(end) > 0 {
-			break
-		}
-
-		keyvals = append(keyvals, key)
-		keyvals = append(keyvals, value)
+	for iter.Valid() && limit > 0 {
+		keyvals = append(keyvals, iter.Key())
+		keyvals = append(keyvals, iter.Value())
 
 		limit--
 		err = iter.Next()
@@ -373,49 +304,13 @@ func (tikv *Tikv) GetRangeKeysVals(start []byte, end []byte, limit uint64, snaps
 	return keyvals, nil
 }
 
+// DeleteRange does not record tombstones in the mvcc version-chain
+// index (see mvcc.go): bulk range deletes are not expected to be
+// time-traveled through key by key the way Delete's targets are.
 func (tikv *Tikv) DeleteRange(start []byte, end []byte, limit uint64) (uint64, error) {
 	// run in txn
-	f := func(txn1 interface{}) (interface{}, error) {
-		txn, _ := txn1.(kv.Transaction)
-
-		ss := txn.GetSnapshot()
-
-		iter, err := ss.Seek(start)
-		if err != nil {
-			return nil, err
-		}
-		defer iter.Close()
-
-		var deleted uint64 = 0
-		// limit == 0 means no limited
-		if limit == 0 {
-			limit = math.MaxUint64
-		}
-
-		for limit > 0 {
-			if !iter.Valid() {
-				break
-			}
-
-			key := iter.Key()
-
-			if end != nil && key.Cmp(end) > 0 {
-				break
-			}
-			err = txn.Delete(key)
-			if err != nil {
-				return nil, err
-			}
-
-			deleted++
-			limit--
-
-			err = iter.Next()
-			if err != nil {
-				return 0, err
-			}
-		}
-		return deleted, nil
+	f := func(txn store.Txn) (interface{}, error) {
+		return store.DeleteRangeInTxn(txn, start, end, limit)
 	}
 
 	v, err := tikv.BatchInTxn(f)
@@ -425,53 +320,11 @@ func (tikv *Tikv) DeleteRange(start []byte, end []byte, limit uint64) (uint64, e
 	return v.(uint64), nil
 }
 
-func (tikv *Tikv) DeleteRangeWithTxn(start []byte, end []byte, limit uint64, txn1 interface{}) (uint64, error) {
-	// run inside txn
-	txn, ok := txn1.(kv.Transaction)
-	if !ok {
-		return 0, terror.ErrBackendType
-	}
-	ss := txn.GetSnapshot()
-
-	iter, err := ss.Seek(start)
-	if err != nil {
-		return 0, err
-	}
-	defer iter.Close()
-
-	var deleted uint64 = 0
-
-	// limit == 0 means no limited
-	if limit == 0 {
-		limit = math.MaxUint64
-	}
-	for limit > 0 {
-		if !iter.Valid() {
-			break
-		}
-
-		key := iter.Key()
-
-		if end != nil && key.Cmp(end) > 0 {
-			break
-		}
-		err = txn.Delete(key)
-		if err != nil {
-			return 0, err
-		}
-
-		deleted++
-		limit--
-
-		err = iter.Next()
-		if err != nil {
-			return 0, err
-		}
-	}
-	return deleted, nil
-
+func (tikv *Tikv) DeleteRangeWithTxn(start []byte, end []byte, limit uint64, txn store.Txn) (uint64, error) {
+	return store.DeleteRangeInTxn(txn, start, end, limit)
 }
-func (tikv *Tikv) BatchInTxn(f func(txn interface{}) (interface{}, error)) (interface{}, error) {
+
+func (tikv *Tikv) BatchInTxn(f func(txn store.Txn) (interface{}, error)) (interface{}, error) {
 	var (
 		retryCount int
 		res        interface{}
@@ -485,7 +338,7 @@ func (tikv *Tikv) BatchInTxn(f func(txn interface{}) (interface{}, error)) (inte
 			return nil, err
 		}
 
-		res, err = f(txn)
+		res, err = f(&Txn{txn: txn, indexEnabled: tikv.mvccEnabled})
 		if err != nil {
 			err1 := txn.Rollback()
 			if err1 != nil {